@@ -1,8 +1,9 @@
 import * as fs from 'fs';
 import * as path from 'path';
 import * as os from 'os';
-import { spawn } from 'child_process';
+import { spawn, type ChildProcess } from 'child_process';
 import { createWriteStream } from 'fs';
+import { Transform } from 'stream';
 import { pipeline } from 'stream/promises';
 
 import { fetch, EnvHttpProxyAgent } from 'undici';
@@ -19,9 +20,25 @@ const ARCH_ARM64 = 'arm64';
 const TAR_BINARY = '/usr/bin/tar';
 const POWERSHELL_BINARY = 'C:\\Windows\\System32\\WindowsPowerShell\\v1.0\\powershell.exe';
 
+// Staging directories for binary installs; leftovers older than this are from a crashed host
+const STAGING_DIR_PREFIX = 'embeddingsearch-install-';
+const STALE_STAGING_AGE_MS = 60 * 60_000;
+
 // Base URL for embedding search releases
 const RELEASE_BASE_URL = 'https://github.com/FloSch62/eda-embeddingsearch/releases/latest/download';
 
+// Download retry policy (exponential backoff starting at the base delay)
+const DOWNLOAD_ATTEMPTS = 3;
+const DOWNLOAD_RETRY_BASE_MS = 1000;
+const DOWNLOAD_PROGRESS_STEP_PERCENT = 25;
+
+// The binary download is aborted when no data arrives for this long, however slow the link.
+// `embeddingsearch setup` is never killed: it prints nothing while fetching the embeddings.
+// A `-json` search also prints nothing until it is done, so its idle timeout is effectively
+// a cap and must leave room for a cold start that loads the database and builds the cache.
+const DOWNLOAD_IDLE_TIMEOUT_MS = 60_000;
+const SEARCH_IDLE_TIMEOUT_MS = 10 * 60_000;
+
 export interface EmbeddingSearchResult {
   topMatch: {
     score: number;
@@ -51,6 +68,140 @@ export interface EmbeddingSearchResult {
   }>;
 }
 
+function parseSearchResultCandidate(text: string): EmbeddingSearchResult | undefined {
+    try {
+        const value: unknown = JSON.parse(text);
+        if (typeof value === 'object' && value !== null && 'topMatch' in value) {
+            return value as EmbeddingSearchResult;
+        }
+    } catch {
+        // Not the result document (e.g. a diagnostic line); the caller tries the next candidate
+    }
+    return undefined;
+}
+
+/**
+ * Parse the JSON document printed by `embeddingsearch -json`.
+ * Some helper builds write diagnostics such as cache-save warnings (possibly
+ * as JSON log lines) to stdout. When the output is not a single document, try
+ * every line opening with `{`: first as the start of a pretty-printed block
+ * ending on the last line that is exactly `}`, then as a compact one-line
+ * result. Only candidates carrying `topMatch` are accepted.
+ */
+export function parseEmbeddingSearchOutput(stdout: string): EmbeddingSearchResult {
+    try {
+        return JSON.parse(stdout) as EmbeddingSearchResult;
+    } catch (error) {
+        const lines = stdout.split(/\r?\n/);
+        let end = lines.length - 1;
+        while (end >= 0 && lines[end].trim() !== '}') {
+            end--;
+        }
+        for (let start = 0; start < lines.length; start++) {
+            if (!lines[start].trimStart().startsWith('{')) {
+                continue;
+            }
+            const result = (start < end ? parseSearchResultCandidate(lines.slice(start, end + 1).join('\n')) : undefined)
+                ?? parseSearchResultCandidate(lines[start]);
+            if (result) {
+                return result;
+            }
+        }
+        throw error;
+    }
+}
+
+/** HTTP status failure while downloading a release asset. */
+export class DownloadHttpError extends Error {
+    readonly status: number;
+
+    constructor(status: number, statusText: string) {
+        super(`Failed to download: ${status} ${statusText}`);
+        this.name = 'DownloadHttpError';
+        this.status = status;
+    }
+}
+
+const RETRYABLE_NETWORK_CODES = new Set(['ECONNRESET', 'ECONNREFUSED', 'ETIMEDOUT', 'EAI_AGAIN', 'EPIPE']);
+
+function hasRetryableNetworkCode(error: unknown): boolean {
+    const code = (error as NodeJS.ErrnoException | undefined)?.code;
+    return typeof code === 'string' && (RETRYABLE_NETWORK_CODES.has(code) || code.startsWith('UND_ERR'));
+}
+
+/**
+ * Only transient failures are worth retrying: network errors, timeouts and
+ * 5xx responses. A 404 for a missing platform asset will not fix itself.
+ */
+export function isRetryableDownloadError(error: unknown): boolean {
+    if (error instanceof DownloadHttpError) {
+        return error.status >= 500;
+    }
+    if (!(error instanceof Error)) {
+        return false;
+    }
+    if (error.name === 'TimeoutError' || error.name === 'AbortError') {
+        return true;
+    }
+    // undici reports connection failures as TypeError('fetch failed') and
+    // mid-body socket errors through `cause`
+    if (error instanceof TypeError && error.message === 'fetch failed') {
+        return true;
+    }
+    return hasRetryableNetworkCode(error) || hasRetryableNetworkCode((error as { cause?: unknown }).cause);
+}
+
+/** Delay before the next attempt after `attempt` (1-based) failed. */
+export function getDownloadRetryDelayMs(attempt: number): number {
+    return DOWNLOAD_RETRY_BASE_MS * 2 ** (attempt - 1);
+}
+
+/**
+ * Progress percentages (multiples of `step`) crossed when the received byte
+ * count moves from `previousBytes` to `receivedBytes`.
+ */
+export function getDownloadProgressMilestones(
+    previousBytes: number,
+    receivedBytes: number,
+    totalBytes: number,
+    step: number = DOWNLOAD_PROGRESS_STEP_PERCENT
+): number[] {
+    if (totalBytes <= 0) {
+        return [];
+    }
+    const previousPercent = Math.min(100, Math.floor((previousBytes / totalBytes) * 100));
+    const currentPercent = Math.min(100, Math.floor((receivedBytes / totalBytes) * 100));
+    const milestones: number[] = [];
+    for (let percent = (Math.floor(previousPercent / step) + 1) * step; percent <= currentPercent; percent += step) {
+        milestones.push(percent);
+    }
+    return milestones;
+}
+
+/**
+ * Check that an archive entry stays inside the extraction directory,
+ * i.e. it is relative and has no `..` segments.
+ */
+export function isSafeArchiveEntry(entry: string): boolean {
+    const normalized = entry.replace(/\\/g, '/');
+    if (normalized.startsWith('/') || /^[a-zA-Z]:/.test(normalized)) {
+        return false;
+    }
+    return !normalized.split('/').includes('..');
+}
+
+/**
+ * Check a line of `tar -tv` output describes a regular file or directory.
+ * GNU tar marks hard links with `h`, bsdtar lists them as files with `link to`.
+ */
+export function isRegularTarListing(line: string): boolean {
+    const type = line.charAt(0);
+    if (type === 'd') {
+        return true;
+    }
+    return type === '-' && !line.includes(' link to ');
+}
+
 export class EmbeddingSearchService {
     private static instance: EmbeddingSearchService;
     private isSetupComplete = false;
@@ -124,35 +275,166 @@ export class EmbeddingSearchService {
 
         log(`Downloading embeddingsearch from ${downloadUrl}`, LogLevel.INFO);
 
+        const isWindows = platform === PLATFORM_WIN32;
+        // Download and extract inside a per-install staging directory so a broken archive never
+        // replaces a working binary and concurrent VS Code windows never share files.
+        // The archive name must not match the `embeddingsearch-*` rename pattern used on extraction.
+        await this.removeStaleStagingDirs();
+        const stagingPath = await fs.promises.mkdtemp(path.join(this.edaPath, STAGING_DIR_PREFIX));
+        const tempFile = path.join(stagingPath, `archive.${isWindows ? 'zip' : 'tar.gz'}`);
+        try {
+            await this.downloadWithRetry(downloadUrl, tempFile);
+
+            if (isWindows) {
+                await this.verifyZipEntries(tempFile);
+                await this.extractZip(tempFile, stagingPath);
+            } else {
+                await this.verifyTarEntries(tempFile);
+                await this.extractTarGz(tempFile, stagingPath);
+            }
+
+            // lstat so a symlink named like the binary cannot redirect chmod/rename outside the staging directory
+            const stagedBinary = path.join(stagingPath, path.basename(this.binaryPath));
+            const stats = await fs.promises.lstat(stagedBinary).catch(() => undefined);
+            if (!stats?.isFile()) {
+                throw new Error(`Archive did not contain ${path.basename(this.binaryPath)} as a regular file`);
+            }
+
+            // Make binary executable on Unix-like systems (owner read/write/execute, group/others read/execute)
+            if (!isWindows) {
+                // eslint-disable-next-line sonarjs/file-permissions -- intentional: downloaded binary must be executable
+                await fs.promises.chmod(stagedBinary, 0o755);
+            }
+
+            await fs.promises.rename(stagedBinary, this.binaryPath);
+        } finally {
+            await fs.promises.rm(stagingPath, { recursive: true, force: true });
+        }
+    }
+
+    private async downloadWithRetry(url: string, destination: string): Promise<void> {
+        for (let attempt = 1; ; attempt++) {
+            try {
+                await this.downloadFile(url, destination);
+                return;
+            } catch (error) {
+                if (attempt >= DOWNLOAD_ATTEMPTS || !isRetryableDownloadError(error)) {
+                    throw error;
+                }
+                const delay = getDownloadRetryDelayMs(attempt);
+                log(`Download attempt ${attempt}/${DOWNLOAD_ATTEMPTS} failed: ${error}. Retrying in ${delay}ms`, LogLevel.WARN);
+                await new Promise((resolve) => setTimeout(resolve, delay));
+            }
+        }
+    }
+
+    private async downloadFile(url: string, destination: string): Promise<void> {
         const proxyEnv = process.env.http_proxy ?? process.env.HTTP_PROXY ?? process.env.https_proxy ?? process.env.HTTPS_PROXY;
         const dispatcher = proxyEnv ? new EnvHttpProxyAgent() : undefined;
-        const response = await fetch(downloadUrl, { dispatcher });
-        if (!response.ok) {
-            throw new Error(`Failed to download: ${response.statusText}`);
+        const controller = new AbortController();
+        const onIdle = () => controller.abort(
+            new DOMException(`No data received for ${DOWNLOAD_IDLE_TIMEOUT_MS}ms`, 'TimeoutError')
+        );
+        let idleTimer = setTimeout(onIdle, DOWNLOAD_IDLE_TIMEOUT_MS);
+        const resetIdleTimer = () => {
+            clearTimeout(idleTimer);
+            idleTimer = setTimeout(onIdle, DOWNLOAD_IDLE_TIMEOUT_MS);
+        };
+
+        try {
+            const response = await fetch(url, { dispatcher, signal: controller.signal });
+            if (!response.ok) {
+                throw new DownloadHttpError(response.status, response.statusText);
+            }
+            if (!response.body) {
+                throw new Error(`Failed to download: empty response body from ${url}`);
+            }
+
+            const totalBytes = Number(response.headers.get('content-length') ?? 0);
+            await pipeline(response.body, this.createProgressLogger(totalBytes, resetIdleTimer), createWriteStream(destination));
+        } finally {
+            clearTimeout(idleTimer);
         }
+    }
 
-        const isWindows = platform === PLATFORM_WIN32;
-        const tempFile = path.join(this.edaPath, `embeddingsearch-temp.${isWindows ? 'zip' : 'tar.gz'}`);
-        const fileStream = createWriteStream(tempFile);
+    private createProgressLogger(totalBytes: number, onData: () => void): Transform {
+        let receivedBytes = 0;
 
-        if (response.body) {
-            await pipeline(response.body, fileStream);
+        return new Transform({
+            transform(chunk: Buffer, _encoding, callback) {
+                onData();
+                const previousBytes = receivedBytes;
+                receivedBytes += chunk.length;
+                for (const percent of getDownloadProgressMilestones(previousBytes, receivedBytes, totalBytes)) {
+                    log(`Embeddingsearch download ${percent}% (${receivedBytes}/${totalBytes} bytes)`, LogLevel.INFO);
+                }
+                callback(null, chunk);
+            }
+        });
+    }
+
+    private async removeStaleStagingDirs(): Promise<void> {
+        const entries = await fs.promises.readdir(this.edaPath, { withFileTypes: true });
+        const now = Date.now();
+        for (const entry of entries) {
+            if (!entry.isDirectory() || !entry.name.startsWith(STAGING_DIR_PREFIX)) {
+                continue;
+            }
+            const stagingPath = path.join(this.edaPath, entry.name);
+            try {
+                // Skip recent directories, another VS Code window may still be installing
+                const stats = await fs.promises.stat(stagingPath);
+                if (now - stats.mtimeMs > STALE_STAGING_AGE_MS) {
+                    await fs.promises.rm(stagingPath, { recursive: true, force: true });
+                }
+            } catch (error) {
+                log(`Failed to remove stale staging directory ${stagingPath}: ${error}`, LogLevel.WARN);
+            }
         }
+    }
+
+    private async listArchiveEntries(command: string, args: string[]): Promise<string[]> {
+        return new Promise((resolve, reject) => {
+            const lister = spawn(command, args);
+            let stdout = '';
 
-        // Extract the archive
-        if (isWindows) {
-            await this.extractZip(tempFile, this.edaPath);
-        } else {
-            await this.extractTarGz(tempFile, this.edaPath);
+            lister.stdout.on('data', (data: Buffer) => {
+                stdout += data.toString();
+            });
+            lister.on('error', reject);
+            lister.on('exit', (code) => {
+                if (code === 0) {
+                    resolve(stdout.split(/\r?\n/).filter((line) => line.length > 0));
+                } else {
+                    reject(new Error(`archive listing failed with code ${code}`));
+                }
+            });
+        });
+    }
+
+    private async verifyTarEntries(archivePath: string): Promise<void> {
+        const entries = await this.listArchiveEntries(TAR_BINARY, ['-tzf', archivePath]);
+        const unsafe = entries.find((entry) => !isSafeArchiveEntry(entry));
+        if (unsafe !== undefined) {
+            throw new Error(`Refusing to extract unsafe archive entry: ${unsafe}`);
         }
 
-        // Clean up temp file
-        await fs.promises.unlink(tempFile);
+        // Names alone hide links, so check entry types from the verbose listing too
+        const listing = await this.listArchiveEntries(TAR_BINARY, ['-tvzf', archivePath]);
+        const link = listing.find((line) => !isRegularTarListing(line));
+        if (link !== undefined) {
+            throw new Error(`Refusing to extract non-regular archive entry: ${link}`);
+        }
+    }
 
-        // Make binary executable on Unix-like systems (owner read/write/execute, group/others read/execute)
-        if (!isWindows) {
-            // eslint-disable-next-line sonarjs/file-permissions -- intentional: downloaded binary must be executable
-            await fs.promises.chmod(this.binaryPath, 0o755);
+    private async verifyZipEntries(archivePath: string): Promise<void> {
+        const entries = await this.listArchiveEntries(POWERSHELL_BINARY, [
+            '-Command',
+            `Add-Type -AssemblyName System.IO.Compression.FileSystem; $zip = [System.IO.Compression.ZipFile]::OpenRead("${archivePath}"); try { $zip.Entries | ForEach-Object { $_.FullName } } finally { $zip.Dispose() }`
+        ]);
+        const unsafe = entries.find((entry) => !isSafeArchiveEntry(entry));
+        if (unsafe !== undefined) {
+            throw new Error(`Refusing to extract unsafe archive entry: ${unsafe}`);
         }
     }
 
@@ -225,8 +507,10 @@ export class EmbeddingSearchService {
                 reject(new Error(`Failed to run embeddingsearch setup: ${error.message}`));
             });
 
-            setupProcess.on('exit', (code) => {
-                if (code === 0) {
+            setupProcess.on('exit', (code, signal) => {
+                if (signal) {
+                    reject(new Error(`embeddingsearch setup terminated by ${signal}`));
+                } else if (code === 0) {
                     if (output.includes('setup completed')) {
                         resolve();
                     } else {
@@ -239,6 +523,29 @@ export class EmbeddingSearchService {
         });
     }
 
+    /**
+     * Kill the child once it has been silent on stdout and stderr for `idleMs`.
+     * Returns a check telling whether the process was stopped for that reason.
+     */
+    private killWhenIdle(child: ChildProcess, idleMs: number): () => boolean {
+        let timedOut = false;
+        const onIdle = () => {
+            timedOut = true;
+            child.kill();
+        };
+        let timer = setTimeout(onIdle, idleMs);
+        const reset = () => {
+            clearTimeout(timer);
+            timer = setTimeout(onIdle, idleMs);
+        };
+
+        child.stdout?.on('data', reset);
+        child.stderr?.on('data', reset);
+        child.on('exit', () => clearTimeout(timer));
+        child.on('error', () => clearTimeout(timer));
+        return () => timedOut;
+    }
+
     async searchNaturalLanguage(query: string): Promise<EmbeddingSearchResult | null> {
         if (!this.isSetupComplete) {
             throw new Error('Embeddingsearch is not ready yet. Please wait for setup to complete.');
@@ -253,6 +560,7 @@ export class EmbeddingSearchService {
             const searchProcess = spawn(this.binaryPath, ['-json', query], {
                 cwd: this.edaPath
             });
+            const timedOut = this.killWhenIdle(searchProcess, SEARCH_IDLE_TIMEOUT_MS);
 
             let stdout = '';
             let stderr = '';
@@ -265,14 +573,22 @@ export class EmbeddingSearchService {
                 stderr += data.toString();
             });
 
-            searchProcess.on('close', (code) => {
+            searchProcess.on('close', (code, signal) => {
+                if (timedOut()) {
+                    reject(new Error(`Embedding search produced no output for ${SEARCH_IDLE_TIMEOUT_MS}ms and was stopped`));
+                    return;
+                }
+                if (signal) {
+                    reject(new Error(`Embedding search terminated by ${signal}`));
+                    return;
+                }
                 if (code !== 0) {
                     reject(new Error(`Embedding search failed: ${stderr}`));
                     return;
                 }
 
                 try {
-                    const result = JSON.parse(stdout) as EmbeddingSearchResult;
+                    const result = parseEmbeddingSearchOutput(stdout);
                     resolve(result);
                 } catch (error) {
                     reject(new Error(`Failed to parse embedding search result: ${String(error)}`));
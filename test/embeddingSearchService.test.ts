@@ -0,0 +1,442 @@
+import { EventEmitter } from 'events';
+import * as fs from 'fs';
+import * as os from 'os';
+import * as path from 'path';
+
+import { expect } from 'chai';
+import sinon from 'sinon';
+// Use CommonJS require to obtain mutable module objects for stubbing
+import childProcess = require('child_process');
+import undici = require('undici');
+
+import * as extension from '../src/extension';
+import {
+  DownloadHttpError,
+  EmbeddingSearchService,
+  getDownloadProgressMilestones,
+  getDownloadRetryDelayMs,
+  isRegularTarListing,
+  isRetryableDownloadError,
+  isSafeArchiveEntry,
+  parseEmbeddingSearchOutput
+} from '../src/services/embeddingSearchService';
+
+const RESULT = {
+  topMatch: {
+    score: 12.5,
+    query: '.namespace.node.srl.interface fields [ oper-state ]',
+    table: '.namespace.node.srl.interface'
+  }
+};
+
+/** Minimal stand-in for a spawned helper process */
+function createFakeChild() {
+  const child = new EventEmitter() as any;
+  child.stdout = new EventEmitter();
+  child.stderr = new EventEmitter();
+  child.killed = false;
+  child.finish = (code: number | null, signal: NodeJS.Signals | null = null) => {
+    child.emit('exit', code, signal);
+    child.emit('close', code, signal);
+  };
+  child.kill = (signal: NodeJS.Signals = 'SIGTERM') => {
+    child.killed = true;
+    child.finish(null, signal);
+    return true;
+  };
+  return child;
+}
+
+/** Fake child that prints `stdout` and exits with `code` on the next tick */
+function exitingChild(code: number, stdout = '') {
+  const child = createFakeChild();
+  setImmediate(() => {
+    if (stdout) {
+      child.stdout.emit('data', Buffer.from(stdout));
+    }
+    child.finish(code);
+  });
+  return child;
+}
+
+describe('parseEmbeddingSearchOutput', () => {
+  it('parses plain JSON output', () => {
+    const parsed = parseEmbeddingSearchOutput(JSON.stringify(RESULT, null, 2));
+    expect(parsed).to.deep.equal(RESULT);
+  });
+
+  it('skips diagnostics printed around the JSON document', () => {
+    const stdout = [
+      'Warning: failed to save binary cache: permission denied',
+      JSON.stringify(RESULT, null, 2),
+      'Loaded embeddings in 1.2s'
+    ].join('\n');
+    expect(parseEmbeddingSearchOutput(stdout)).to.deep.equal(RESULT);
+  });
+
+  it('ignores trailing lines containing braces', () => {
+    const pretty = JSON.stringify(RESULT, null, 2);
+    expect(parseEmbeddingSearchOutput(`${pretty}\nLoaded {srl} in 1s`)).to.deep.equal(RESULT);
+    expect(parseEmbeddingSearchOutput(`${pretty}\nstats: map[a:1] done}`)).to.deep.equal(RESULT);
+  });
+
+  it('skips leading JSON log lines', () => {
+    const stdout = [
+      '{"level":"warn","msg":"cache save failed"}',
+      JSON.stringify(RESULT, null, 2)
+    ].join('\n');
+    expect(parseEmbeddingSearchOutput(stdout)).to.deep.equal(RESULT);
+  });
+
+  it('finds a compact result after a leading warning', () => {
+    const stdout = ['Warning: failed to save binary cache', JSON.stringify(RESULT)].join('\n');
+    expect(parseEmbeddingSearchOutput(stdout)).to.deep.equal(RESULT);
+  });
+
+  it('does not return a JSON log line as the result', () => {
+    const stdout = ['{"level":"warn","msg":"cache save failed"}', 'no results'].join('\n');
+    expect(() => parseEmbeddingSearchOutput(stdout)).to.throw(SyntaxError);
+  });
+
+  it('throws when no JSON document is present', () => {
+    expect(() => parseEmbeddingSearchOutput('setup completed')).to.throw(SyntaxError);
+  });
+});
+
+describe('isSafeArchiveEntry', () => {
+  it('accepts relative entries', () => {
+    expect(isSafeArchiveEntry('embeddingsearch-linux-amd64')).to.equal(true);
+    expect(isSafeArchiveEntry('./bin/embeddingsearch')).to.equal(true);
+  });
+
+  it('rejects absolute paths', () => {
+    expect(isSafeArchiveEntry('/usr/local/bin/embeddingsearch')).to.equal(false);
+    expect(isSafeArchiveEntry('C:\\Windows\\embeddingsearch.exe')).to.equal(false);
+  });
+
+  it('rejects parent directory segments', () => {
+    expect(isSafeArchiveEntry('../embeddingsearch')).to.equal(false);
+    expect(isSafeArchiveEntry('bin/../../.bashrc')).to.equal(false);
+    expect(isSafeArchiveEntry('bin\\..\\..\\evil')).to.equal(false);
+  });
+});
+
+describe('isRegularTarListing', () => {
+  it('accepts regular files and directories', () => {
+    expect(isRegularTarListing('-rwxr-xr-x runner/docker 41234 2025-06-01 10:00 embeddingsearch-linux-amd64')).to.equal(true);
+    expect(isRegularTarListing('drwxr-xr-x runner/docker     0 2025-06-01 10:00 ./')).to.equal(true);
+  });
+
+  it('rejects symbolic links', () => {
+    expect(isRegularTarListing('lrwxrwxrwx root/root 0 2025-06-01 10:00 embeddingsearch-linux-amd64 -> /etc/passwd')).to.equal(false);
+  });
+
+  it('rejects hard links in GNU and bsdtar listings', () => {
+    expect(isRegularTarListing('hrw-r--r-- root/root 0 2025-06-01 10:00 embeddingsearch-linux link to ../evil')).to.equal(false);
+    expect(isRegularTarListing('-rw-r--r--  0 root root 0 Jun  1 10:00 embeddingsearch-darwin link to ../evil')).to.equal(false);
+  });
+});
+
+describe('isRetryableDownloadError', () => {
+  it('retries server errors but not client errors', () => {
+    expect(isRetryableDownloadError(new DownloadHttpError(503, 'Service Unavailable'))).to.equal(true);
+    expect(isRetryableDownloadError(new DownloadHttpError(404, 'Not Found'))).to.equal(false);
+    expect(isRetryableDownloadError(new DownloadHttpError(403, 'Forbidden'))).to.equal(false);
+  });
+
+  it('retries network failures and timeouts', () => {
+    expect(isRetryableDownloadError(new TypeError('fetch failed'))).to.equal(true);
+    expect(isRetryableDownloadError(new DOMException('timed out', 'TimeoutError'))).to.equal(true);
+    const reset = Object.assign(new Error('socket hang up'), { code: 'ECONNRESET' });
+    expect(isRetryableDownloadError(reset)).to.equal(true);
+    const terminated = Object.assign(new TypeError('terminated'), { cause: { code: 'UND_ERR_SOCKET' } });
+    expect(isRetryableDownloadError(terminated)).to.equal(true);
+  });
+
+  it('does not retry programming errors', () => {
+    expect(isRetryableDownloadError(new TypeError("Cannot read properties of undefined (reading 'get')"))).to.equal(false);
+  });
+
+  it('does not retry other errors', () => {
+    const denied = Object.assign(new Error('permission denied'), { code: 'EACCES' });
+    expect(isRetryableDownloadError(denied)).to.equal(false);
+    expect(isRetryableDownloadError(new Error('empty response body'))).to.equal(false);
+  });
+});
+
+describe('getDownloadRetryDelayMs', () => {
+  it('doubles the delay for each failed attempt', () => {
+    expect([1, 2, 3].map(getDownloadRetryDelayMs)).to.deep.equal([1000, 2000, 4000]);
+  });
+});
+
+describe('EmbeddingSearchService.downloadWithRetry', () => {
+  const DOWNLOAD_URL = 'https://example.test/embeddingsearch-linux-amd64.tar.gz';
+  let fetchStub: sinon.SinonStub;
+  let clock: sinon.SinonFakeTimers;
+  let tmpDir: string;
+
+  beforeEach(async () => {
+    fetchStub = sinon.stub(undici, 'fetch');
+    sinon.stub(extension, 'log');
+    clock = sinon.useFakeTimers({ toFake: ['setTimeout', 'clearTimeout'] });
+    tmpDir = await fs.promises.mkdtemp(path.join(os.tmpdir(), 'embeddingsearch-test-'));
+  });
+
+  afterEach(async () => {
+    clock.restore();
+    sinon.restore();
+    await fs.promises.rm(tmpDir, { recursive: true, force: true });
+  });
+
+  it('retries a 5xx response and writes the next successful body', async () => {
+    fetchStub
+      .onFirstCall()
+      .resolves(new Response(null, { status: 503, statusText: 'Service Unavailable' }))
+      .onSecondCall()
+      .resolves(new Response('archive-bytes', { status: 200 }));
+    const destination = path.join(tmpDir, 'archive.tar.gz');
+
+    const service = new (EmbeddingSearchService as any)();
+    const pending = service.downloadWithRetry(DOWNLOAD_URL, destination);
+    await clock.tickAsync(getDownloadRetryDelayMs(1));
+    await pending;
+
+    expect(fetchStub.calledTwice).to.equal(true);
+    expect(await fs.promises.readFile(destination, 'utf8')).to.equal('archive-bytes');
+  });
+
+  it('fails a 4xx response without retrying', async () => {
+    fetchStub.resolves(new Response(null, { status: 404, statusText: 'Not Found' }));
+
+    const service = new (EmbeddingSearchService as any)();
+    let error: unknown;
+    try {
+      await service.downloadWithRetry(DOWNLOAD_URL, path.join(tmpDir, 'archive.tar.gz'));
+    } catch (err) {
+      error = err;
+    }
+
+    expect(error).to.be.instanceOf(DownloadHttpError);
+    expect((error as DownloadHttpError).status).to.equal(404);
+    expect(fetchStub.calledOnce).to.equal(true);
+  });
+});
+
+describe('EmbeddingSearchService.downloadBinary', () => {
+  const BINARY_ENTRY = 'embeddingsearch-linux-amd64';
+  let tmpDir: string;
+  let binaryPath: string;
+  let spawnStub: sinon.SinonStub;
+
+  function createService() {
+    const service = new (EmbeddingSearchService as any)();
+    service.edaPath = tmpDir;
+    service.binaryPath = binaryPath;
+    return service;
+  }
+
+  async function stagingDirs(): Promise<string[]> {
+    const entries = await fs.promises.readdir(tmpDir);
+    return entries.filter((entry) => entry.startsWith('embeddingsearch-install-'));
+  }
+
+  async function downloadError(service: any): Promise<Error | undefined> {
+    try {
+      await service.downloadBinary();
+    } catch (err) {
+      return err as Error;
+    }
+    return undefined;
+  }
+
+  beforeEach(async () => {
+    sinon.stub(undici, 'fetch').callsFake(async () => new Response('archive-bytes', { status: 200 }) as any);
+    sinon.stub(extension, 'log');
+    spawnStub = sinon.stub(childProcess, 'spawn');
+    tmpDir = await fs.promises.mkdtemp(path.join(os.tmpdir(), 'embeddingsearch-test-'));
+    binaryPath = path.join(tmpDir, 'embeddingsearch');
+    await fs.promises.writeFile(binaryPath, 'old-binary');
+  });
+
+  afterEach(async () => {
+    sinon.restore();
+    await fs.promises.rm(tmpDir, { recursive: true, force: true });
+  });
+
+  it('keeps the installed binary when verification rejects a link entry', async () => {
+    spawnStub.callsFake((_command: string, args: string[]) => {
+      if (args[0] === '-tzf') {
+        return exitingChild(0, `${BINARY_ENTRY}\n`);
+      }
+      if (args[0] === '-tvzf') {
+        return exitingChild(0, `lrwxrwxrwx root/root 0 2025-06-01 10:00 ${BINARY_ENTRY} -> /etc/passwd\n`);
+      }
+      return exitingChild(0);
+    });
+
+    const error = await downloadError(createService());
+
+    expect(error?.message).to.match(/non-regular archive entry/);
+    expect(spawnStub.getCalls().some((call) => call.args[1][0] === '-xzf')).to.equal(false);
+    expect(await fs.promises.readFile(binaryPath, 'utf8')).to.equal('old-binary');
+    expect(await stagingDirs()).to.deep.equal([]);
+  });
+
+  it('keeps the installed binary when extraction fails', async () => {
+    spawnStub.callsFake((_command: string, args: string[]) => {
+      if (args[0] === '-tzf') {
+        return exitingChild(0, `${BINARY_ENTRY}\n`);
+      }
+      if (args[0] === '-tvzf') {
+        return exitingChild(0, `-rwxr-xr-x root/root 5 2025-06-01 10:00 ${BINARY_ENTRY}\n`);
+      }
+      return exitingChild(2);
+    });
+
+    const error = await downloadError(createService());
+
+    expect(error?.message).to.match(/tar extraction failed/);
+    expect(await fs.promises.readFile(binaryPath, 'utf8')).to.equal('old-binary');
+    expect(await stagingDirs()).to.deep.equal([]);
+  });
+
+  it('replaces the binary once the extracted file is verified', async () => {
+    spawnStub.callsFake((_command: string, args: string[]) => {
+      if (args[0] === '-tzf') {
+        return exitingChild(0, `${BINARY_ENTRY}\n`);
+      }
+      if (args[0] === '-tvzf') {
+        return exitingChild(0, `-rwxr-xr-x root/root 5 2025-06-01 10:00 ${BINARY_ENTRY}\n`);
+      }
+      // `-xzf <archive> -C <staging>` with the rename transform applied
+      fs.writeFileSync(path.join(args[3], 'embeddingsearch'), 'new-binary');
+      return exitingChild(0);
+    });
+
+    const error = await downloadError(createService());
+
+    expect(error).to.equal(undefined);
+    expect(await fs.promises.readFile(binaryPath, 'utf8')).to.equal('new-binary');
+    expect(await stagingDirs()).to.deep.equal([]);
+  });
+});
+
+describe('EmbeddingSearchService.killWhenIdle', () => {
+  let clock: sinon.SinonFakeTimers;
+
+  beforeEach(() => {
+    clock = sinon.useFakeTimers({ toFake: ['setTimeout', 'clearTimeout'] });
+  });
+
+  afterEach(() => {
+    clock.restore();
+    sinon.restore();
+  });
+
+  it('kills the child after the idle period', () => {
+    const child = createFakeChild();
+    const timedOut = new (EmbeddingSearchService as any)().killWhenIdle(child, 1000);
+
+    clock.tick(999);
+    expect(child.killed).to.equal(false);
+    clock.tick(1);
+    expect(child.killed).to.equal(true);
+    expect(timedOut()).to.equal(true);
+  });
+
+  it('restarts the idle period on stdout and stderr output', () => {
+    const child = createFakeChild();
+    const timedOut = new (EmbeddingSearchService as any)().killWhenIdle(child, 1000);
+
+    clock.tick(800);
+    child.stdout.emit('data', Buffer.from('Loading'));
+    clock.tick(800);
+    child.stderr.emit('data', Buffer.from('warning'));
+    clock.tick(800);
+    expect(child.killed).to.equal(false);
+    clock.tick(200);
+    expect(child.killed).to.equal(true);
+    expect(timedOut()).to.equal(true);
+  });
+
+  it('clears the timer when the child exits', () => {
+    const child = createFakeChild();
+    const timedOut = new (EmbeddingSearchService as any)().killWhenIdle(child, 1000);
+
+    child.finish(0);
+    expect(clock.countTimers()).to.equal(0);
+    clock.tick(2000);
+    expect(child.killed).to.equal(false);
+    expect(timedOut()).to.equal(false);
+  });
+});
+
+describe('EmbeddingSearchService.searchNaturalLanguage', () => {
+  let clock: sinon.SinonFakeTimers;
+  let tmpDir: string;
+  let child: any;
+
+  async function searchError(service: any): Promise<Error | undefined> {
+    try {
+      await service.searchNaturalLanguage('interfaces on leaf1');
+    } catch (err) {
+      return err as Error;
+    }
+    return undefined;
+  }
+
+  function createService() {
+    const service = new (EmbeddingSearchService as any)();
+    service.isSetupComplete = true;
+    service.binaryPath = path.join(tmpDir, 'embeddingsearch');
+    return service;
+  }
+
+  beforeEach(async () => {
+    tmpDir = await fs.promises.mkdtemp(path.join(os.tmpdir(), 'embeddingsearch-test-'));
+    await fs.promises.writeFile(path.join(tmpDir, 'embeddingsearch'), '');
+    child = createFakeChild();
+    sinon.stub(childProcess, 'spawn').returns(child);
+    clock = sinon.useFakeTimers({ toFake: ['setTimeout', 'clearTimeout'] });
+  });
+
+  afterEach(async () => {
+    clock.restore();
+    sinon.restore();
+    await fs.promises.rm(tmpDir, { recursive: true, force: true });
+  });
+
+  it('reports a timeout when the search is stopped for inactivity', async () => {
+    const pending = searchError(createService());
+    clock.runAll();
+
+    const error = await pending;
+    expect(child.killed).to.equal(true);
+    expect(error?.message).to.match(/produced no output for \d+ms and was stopped/);
+  });
+
+  it('reports other signals without blaming the timeout', async () => {
+    const pending = searchError(createService());
+    child.finish(null, 'SIGKILL');
+
+    const error = await pending;
+    expect(error?.message).to.equal('Embedding search terminated by SIGKILL');
+  });
+});
+
+describe('getDownloadProgressMilestones', () => {
+  it('reports each step crossed by a chunk', () => {
+    expect(getDownloadProgressMilestones(0, 30, 100)).to.deep.equal([25]);
+    expect(getDownloadProgressMilestones(30, 80, 100)).to.deep.equal([50, 75]);
+    expect(getDownloadProgressMilestones(80, 100, 100)).to.deep.equal([100]);
+  });
+
+  it('reports nothing when no step is crossed', () => {
+    expect(getDownloadProgressMilestones(26, 49, 100)).to.deep.equal([]);
+  });
+
+  it('reports nothing without a known total size', () => {
+    expect(getDownloadProgressMilestones(0, 500, 0)).to.deep.equal([]);
+  });
+});